@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// userPassVersion is the subnegotiation version for RFC 1929
+// username/password authentication.
+const userPassVersion = uint8(0x01)
+
+const (
+	userPassAuthSuccess = uint8(0x00)
+	userPassAuthFailure = uint8(0x01)
+)
+
+const (
+	noAuthCode   = uint8(0x00)
+	userPassCode = uint8(0x02)
+	noAcceptable = uint8(0xff)
+)
+
+// AuthContext carries the result of a successful authentication so that
+// downstream rule/ACL hooks can see who the authenticated user is.
+type AuthContext struct {
+	// Method is the socksMethod code that was used to authenticate.
+	Method uint8
+	// User is the authenticated username, empty for NoAuthAuthenticator.
+	User string
+}
+
+// Authenticator is a pluggable method-selection handler. GetCode reports the
+// socks method byte this authenticator answers for, Authenticate performs
+// the (possibly empty) subnegotiation once that method has been selected.
+type Authenticator interface {
+	GetCode() uint8
+	Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error)
+}
+
+// NoAuthAuthenticator implements the noAuth (0x00) method: no subnegotiation
+// is required, the connection is authenticated as soon as it is selected.
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) GetCode() uint8 {
+	return noAuthCode
+}
+
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	_, err := writer.Write([]byte{socksVersion, noAuthCode})
+	if err != nil {
+		return nil, err
+	}
+	return &AuthContext{Method: noAuthCode}, nil
+}
+
+// CredentialStore validates a username/password pair. Implementations can be
+// backed by static maps, files, or external stores.
+type CredentialStore interface {
+	Valid(user, pass string) bool
+}
+
+// StaticCredentialStore is a CredentialStore backed by an in-memory map of
+// username to password.
+type StaticCredentialStore map[string]string
+
+func (s StaticCredentialStore) Valid(user, pass string) bool {
+	wanted, ok := s[user]
+	return ok && wanted == pass
+}
+
+// UserPassAuthenticator implements RFC 1929 username/password
+// authentication.
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+func (a UserPassAuthenticator) GetCode() uint8 {
+	return userPassCode
+}
+
+func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	if _, err := writer.Write([]byte{socksVersion, userPassCode}); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read user/pass header: %v", err)
+	}
+	if header[0] != userPassVersion {
+		return nil, fmt.Errorf("unsupported user/pass version: %d", header[0])
+	}
+
+	userLen := int(header[1])
+	user := make([]byte, userLen)
+	if _, err := io.ReadFull(reader, user); err != nil {
+		return nil, fmt.Errorf("failed to read username: %v", err)
+	}
+
+	passLen := []byte{0}
+	if _, err := io.ReadFull(reader, passLen); err != nil {
+		return nil, fmt.Errorf("failed to read password length: %v", err)
+	}
+	pass := make([]byte, int(passLen[0]))
+	if _, err := io.ReadFull(reader, pass); err != nil {
+		return nil, fmt.Errorf("failed to read password: %v", err)
+	}
+
+	if !a.Credentials.Valid(string(user), string(pass)) {
+		writer.Write([]byte{userPassVersion, userPassAuthFailure})
+		return nil, fmt.Errorf("invalid credentials for user %q from %s", user, userAddr)
+	}
+
+	if _, err := writer.Write([]byte{userPassVersion, userPassAuthSuccess}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{Method: userPassCode, User: string(user)}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// handleCommandBind implements the BIND command from RFC 1928: open a
+// listener on an ephemeral port, tell the client about it, wait for exactly
+// one inbound connection, tell the client who connected, then let the
+// caller splice the two connections together like CONNECT does.
+//
+// Unlike handleCommandConnect, handleCommandBind writes both of its own
+// replies directly to s.conn and returns no payload, since BIND needs two
+// replies instead of one.
+func (s *SocksProxy) handleCommandBind(ctx context.Context) ([]byte, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		s.closeConnectionWithError(generalFailure)
+		return nil, fmt.Errorf("failed to listen for BIND: %v", err)
+	}
+	defer listener.Close()
+
+	bindAddress := listener.Addr().(*net.TCPAddr)
+	log.Printf("BIND: listening on %v", bindAddress)
+
+	s.reply = succeeded
+	if _, err := s.conn.Write(s.generateSucceededReply(bindAddress.AddrPort())); err != nil {
+		return nil, fmt.Errorf("failed to send first BIND reply: %v", err)
+	}
+
+	acceptDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-acceptDone:
+		}
+	}()
+
+	peer, err := listener.Accept()
+	close(acceptDone)
+	if err != nil {
+		s.closeConnectionWithError(generalFailure)
+		return nil, fmt.Errorf("failed to accept BIND connection: %v", err)
+	}
+	s.remote = peer
+
+	peerAddress := peer.RemoteAddr().(*net.TCPAddr)
+	log.Printf("BIND: accepted connection from %v", peerAddress)
+
+	if s.conn == nil {
+		peer.Close()
+		return nil, fmt.Errorf("connection closed before second BIND reply")
+	}
+	if _, err := s.conn.Write(s.generateSucceededReply(peerAddress.AddrPort())); err != nil {
+		return nil, fmt.Errorf("failed to send second BIND reply: %v", err)
+	}
+
+	return nil, nil
+}
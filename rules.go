@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Request is the parsed request header, handed to a RuleSet so it can
+// decide whether to let the command through.
+type Request struct {
+	Command     socksCommand
+	AddressType socksAddressType
+	DstIP       netip.Addr
+	DstFQDN     string
+	DstPort     uint16
+	AuthContext *AuthContext
+}
+
+// RuleSet decides whether a request is allowed to proceed. It is evaluated
+// once the request header has been parsed, before the command is executed.
+// Returning false causes the server to reply connectionNotAllowed and close
+// the connection. The returned context lets a RuleSet stash information
+// (e.g. the matched policy) for later hooks such as a NameResolver.
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) (context.Context, bool)
+}
+
+// NameResolver resolves a domain name to an IP address, replacing the
+// inline net.LookupIP call used for the domainName address type.
+type NameResolver interface {
+	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
+}
+
+// DNSResolver is the default NameResolver, backed by net.DefaultResolver.
+type DNSResolver struct{}
+
+func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if len(ips) == 0 {
+		return ctx, nil, fmt.Errorf("no such host: %s", name)
+	}
+	return ctx, ips[0].IP, nil
+}
+
+// PermitCommand is a RuleSet that toggles which of CONNECT/BIND/UDP
+// ASSOCIATE are allowed, independent of destination.
+type PermitCommand struct {
+	EnableConnect      bool
+	EnableBind         bool
+	EnableUDPAssociate bool
+}
+
+func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	switch req.Command {
+	case connect:
+		return ctx, p.EnableConnect
+	case bind:
+		return ctx, p.EnableBind
+	case udpAssociate:
+		return ctx, p.EnableUDPAssociate
+	default:
+		return ctx, false
+	}
+}
+
+// PermitAll permits CONNECT, BIND and UDP ASSOCIATE unconditionally. It is
+// the default RuleSet used when a Server has none configured.
+var PermitAll RuleSet = &PermitCommand{
+	EnableConnect:      true,
+	EnableBind:         true,
+	EnableUDPAssociate: true,
+}
+
+// PermitDestAddrPattern is a RuleSet that allows or denies requests based
+// on the destination IP (via CIDR) or FQDN (via a "*.example.com" style
+// suffix pattern). An empty Allowed list means "no restriction" for that
+// kind of destination; Denied always takes precedence over Allowed.
+type PermitDestAddrPattern struct {
+	AllowedNets []*net.IPNet
+	DeniedNets  []*net.IPNet
+	AllowedFQDN []string
+	DeniedFQDN  []string
+}
+
+// Allow is called twice for a domainName CONNECT that is dialed directly:
+// once with only DstFQDN known, before the name is resolved, and again by
+// SocksProxy.constructRemoteAddress with DstIP set to the resolved address
+// once it is. The first call lets FQDN patterns match; the second lets
+// CIDR rules catch a domain that resolves into a denied range (e.g. a
+// private network), which the FQDN-only call cannot see. A domainName
+// CONNECT forwarded to an upstream proxy, and a domainName BIND or UDP
+// ASSOCIATE request, is never resolved here and gets only the FQDN check.
+func (p *PermitDestAddrPattern) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.DstFQDN != "" {
+		return ctx, p.allowFQDN(req.DstFQDN)
+	}
+	return ctx, p.allowIP(net.IP(req.DstIP.AsSlice()))
+}
+
+func (p *PermitDestAddrPattern) allowIP(ip net.IP) bool {
+	for _, n := range p.DeniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.AllowedNets) == 0 {
+		return true
+	}
+	for _, n := range p.AllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PermitDestAddrPattern) allowFQDN(fqdn string) bool {
+	for _, pattern := range p.DeniedFQDN {
+		if matchFQDNPattern(pattern, fqdn) {
+			return false
+		}
+	}
+	if len(p.AllowedFQDN) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowedFQDN {
+		if matchFQDNPattern(pattern, fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFQDNPattern matches fqdn against pattern, where a "*." prefix on
+// pattern matches any subdomain as well as the base domain itself.
+func matchFQDNPattern(pattern, fqdn string) bool {
+	if pattern == fqdn {
+		return true
+	}
+	if rest, ok := strings.CutPrefix(pattern, "*."); ok {
+		return fqdn == rest || strings.HasSuffix(fqdn, "."+rest)
+	}
+	return false
+}
+
+// toRequest builds the Request passed to a RuleSet from the proxy's
+// already-parsed header fields.
+func (s *SocksProxy) toRequest() *Request {
+	return &Request{
+		Command:     s.command,
+		AddressType: s.addressType,
+		DstIP:       s.IP,
+		DstFQDN:     s.FQDN,
+		DstPort:     s.port,
+		AuthContext: s.authContext,
+	}
+}
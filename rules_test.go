@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMatchFQDNPattern(t *testing.T) {
+	cases := []struct {
+		pattern, fqdn string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "evil.com", false},
+		{"*.example.com", "example.com", true},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "evil.com", false},
+		{"*.example.com", "notexample.com", false},
+	}
+	for _, c := range cases {
+		if got := matchFQDNPattern(c.pattern, c.fqdn); got != c.want {
+			t.Errorf("matchFQDNPattern(%q, %q) = %v, want %v", c.pattern, c.fqdn, got, c.want)
+		}
+	}
+}
+
+func TestPermitDestAddrPatternIP(t *testing.T) {
+	_, denied, _ := net.ParseCIDR("10.0.0.0/8")
+	p := &PermitDestAddrPattern{DeniedNets: []*net.IPNet{denied}}
+
+	req := &Request{DstIP: netip.MustParseAddr("10.1.2.3")}
+	if _, ok := p.Allow(context.Background(), req); ok {
+		t.Errorf("expected 10.1.2.3 to be denied by 10.0.0.0/8")
+	}
+
+	req = &Request{DstIP: netip.MustParseAddr("8.8.8.8")}
+	if _, ok := p.Allow(context.Background(), req); !ok {
+		t.Errorf("expected 8.8.8.8 to be allowed with no matching deny rule")
+	}
+}
+
+func TestPermitDestAddrPatternFQDN(t *testing.T) {
+	p := &PermitDestAddrPattern{DeniedFQDN: []string{"*.evil.com"}}
+
+	req := &Request{DstFQDN: "www.evil.com"}
+	if _, ok := p.Allow(context.Background(), req); ok {
+		t.Errorf("expected www.evil.com to be denied")
+	}
+
+	req = &Request{DstFQDN: "example.com"}
+	if _, ok := p.Allow(context.Background(), req); !ok {
+		t.Errorf("expected example.com to be allowed with no matching deny rule")
+	}
+}
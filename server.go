@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/netip"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"toy-socks5/statute"
 )
 
 // constants
@@ -17,69 +23,55 @@ const (
 	port         = 1081
 )
 
+// aLongTimeAgo is used to force blocking reads/writes on conn to time out,
+// unblocking a goroutine that is waiting on them when ctx is cancelled.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// DialFunc dials a remote address the way net.Dialer.DialContext does,
+// letting callers swap in a custom dialer (e.g. to chain through an
+// upstream proxy).
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
 // SocksMethod is the authentication method to be used.
 // noAuth means no authentication at all
 type socksMethod uint8
 
 const (
-	noAuth socksMethod = socksMethod(0x00)
+	noAuth   socksMethod = socksMethod(noAuthCode)
+	userPass socksMethod = socksMethod(userPassCode)
 )
 
-type socksCommand uint8
+// socksCommand, socksAddressType and socksReply are aliases onto the wire
+// types in statute, so the rest of this file can keep using its own short
+// names for them.
+type socksCommand = statute.Command
+type socksAddressType = statute.AddrType
+type socksReply = statute.ReplyCode
 
 const (
-	connect      = socksCommand(0x01)
-	bind         = socksCommand(0x02)
-	udpAssociate = socksCommand(0x03)
+	connect      = statute.CommandConnect
+	bind         = statute.CommandBind
+	udpAssociate = statute.CommandUDPAssociate
 )
 
-type socksAddressType uint8
-
 const (
-	ipv4       = socksAddressType(0x01)
-	domainName = socksAddressType(0x03)
-	ipv6       = socksAddressType(0x04)
+	ipv4       = statute.ATYPIPv4
+	domainName = statute.ATYPDomain
+	ipv6       = statute.ATYPIPv6
 )
 
-type socksReply uint8
-
 const (
-	succeeded               = socksReply(0x00)
-	generalFailure          = socksReply(0x01)
-	connectionNotAllowed    = socksReply(0x02)
-	networkUnreachable      = socksReply(0x03)
-	hostUnreachable         = socksReply(0x04)
-	connectionRefused       = socksReply(0x05)
-	ttlExpired              = socksReply(0x06)
-	commandNotSupported     = socksReply(0x07)
-	addressTypeNotSupported = socksReply(0x08)
+	succeeded               = statute.RepSuccess
+	generalFailure          = statute.RepGeneralFailure
+	connectionNotAllowed    = statute.RepConnectionNotAllowed
+	networkUnreachable      = statute.RepNetworkUnreachable
+	hostUnreachable         = statute.RepHostUnreachable
+	connectionRefused       = statute.RepConnectionRefused
+	ttlExpired              = statute.RepTTLExpired
+	commandNotSupported     = statute.RepCommandNotSupported
+	addressTypeNotSupported = statute.RepAddrTypeNotSupported
 )
 
-func (r socksReply) String() string {
-	switch r {
-	case succeeded:
-		return "succeeded"
-	case generalFailure:
-		return "general failure"
-	case connectionNotAllowed:
-		return "connection not allowed"
-	case networkUnreachable:
-		return "network unreachable"
-	case hostUnreachable:
-		return "host unreachable"
-	case connectionRefused:
-		return "connection refused"
-	case ttlExpired:
-		return "ttl expired"
-	case commandNotSupported:
-		return "command not supported"
-	case addressTypeNotSupported:
-		return "address type not supported"
-	default:
-		return fmt.Sprintf("unknown(%d)", r)
-	}
-}
-
 // SocksProxy handles the connection
 type SocksProxy struct {
 	version     uint8
@@ -92,17 +84,203 @@ type SocksProxy struct {
 	port        uint16
 	remote      net.Conn
 	methods     []uint8
+
+	// authenticators maps a socks method code to the Authenticator that
+	// handles it. The server advertises whichever of these it has
+	// configured and selects among the client's requested methods in
+	// authenticatorOrder, i.e. server preference, not client order.
+	authenticators map[uint8]Authenticator
+	// authenticatorOrder lists the configured method codes from strongest
+	// to weakest, set alongside authenticators by NewProxy/SetAuthenticators.
+	authenticatorOrder []uint8
+	// authContext is the result of the successful authentication,
+	// available to downstream rule/ACL hooks.
+	authContext *AuthContext
+
+	// dial opens the remote connection for the connect command. Set by
+	// Server.handle; falls back to a plain net.Dialer when nil (e.g. when
+	// a SocksProxy is used directly, outside of a Server).
+	dial DialFunc
+
+	// udpAssoc is set by handleCommandUDPAssociate and relays datagrams
+	// for the lifetime of the controlling TCP connection.
+	udpAssoc *udpAssociation
+
+	// resolver resolves domainName requests to an IP. Set by
+	// Server.handle; falls back to DNSResolver when nil.
+	resolver NameResolver
+
+	// ruleSet is re-consulted in constructRemoteAddress once a domainName
+	// request resolves to an IP, so that CIDR-based rules (which the
+	// initial toRequest() check cannot see, since only the FQDN is known
+	// at that point) still apply to domains resolving into a denied
+	// range. Set by Server.handle; nil disables the recheck.
+	ruleSet RuleSet
+
+	// upstream, if set, lets CONNECT be forwarded to another SOCKS5
+	// server instead of being dialed directly. upstreamRoute decides
+	// which destinations take that path; nil means all of them do.
+	upstream      ProxyDialer
+	upstreamRoute UpstreamRoute
 }
 
-// NewProxy creates a SocksProxy
+// NewProxy creates a SocksProxy. By default it only offers noAuth; call
+// SetAuthenticators to advertise additional methods such as user/pass.
 func NewProxy(c net.Conn) *SocksProxy {
 	s := SocksProxy{}
 	s.version = uint8(5)
 	s.conn = c
 	s.IP = netip.Addr{}
+	s.authenticators = map[uint8]Authenticator{
+		noAuthCode: NoAuthAuthenticator{},
+	}
+	s.authenticatorOrder = []uint8{noAuthCode}
 	return &s
 }
 
+// SetAuthenticators replaces the set of Authenticators the proxy will
+// advertise during method negotiation. authenticators is given strongest
+// first; that order, not the client's, decides which method is selected
+// when several are mutually acceptable.
+func (s *SocksProxy) SetAuthenticators(authenticators ...Authenticator) {
+	s.authenticators = make(map[uint8]Authenticator, len(authenticators))
+	s.authenticatorOrder = make([]uint8, 0, len(authenticators))
+	for _, a := range authenticators {
+		s.authenticators[a.GetCode()] = a
+		s.authenticatorOrder = append(s.authenticatorOrder, a.GetCode())
+	}
+}
+
+// Server holds the configuration for running one or more socks proxy
+// listeners, bounding how long DNS/dial may take and letting callers cancel
+// in-flight requests on shutdown.
+type Server struct {
+	// DialTimeout bounds how long dialing the remote address may take.
+	// Zero means no additional timeout beyond ctx.
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds how long the greeting and request header
+	// parsing may take. Zero means no additional timeout beyond ctx.
+	HandshakeTimeout time.Duration
+	// BaseContext, if non-nil, supplies the base context for all
+	// connections accepted on listener. Defaults to context.Background().
+	BaseContext func(listener net.Listener) context.Context
+	// Dial opens remote connections for the connect command. Defaults to
+	// (&net.Dialer{}).DialContext.
+	Dial DialFunc
+	// RuleSet decides whether a request may proceed. Defaults to
+	// PermitAll.
+	RuleSet RuleSet
+	// Resolver resolves domainName requests to an IP. Defaults to
+	// DNSResolver.
+	Resolver NameResolver
+	// Upstream, if set, lets CONNECT be forwarded to another SOCKS5
+	// server (e.g. Tor) instead of being dialed directly.
+	Upstream ProxyDialer
+	// UpstreamRoute decides which destinations go via Upstream. Nil means
+	// all of them do, once Upstream is set.
+	UpstreamRoute UpstreamRoute
+	// Authenticators, if non-empty, replaces the default noAuth-only
+	// method list offered during the greeting. See SetAuthenticators.
+	Authenticators []Authenticator
+
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	listener net.Listener
+}
+
+// NewServer creates a Server with a default Dialer and no timeouts.
+func NewServer() *Server {
+	return &Server{Dial: (&net.Dialer{}).DialContext}
+}
+
+// dialFunc returns a DialFunc that applies DialTimeout (if set) on top of
+// srv.Dial (or a default net.Dialer if Dial is nil).
+func (srv *Server) dialFunc() DialFunc {
+	dial := srv.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	timeout := srv.DialTimeout
+	if timeout <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
+
+// ruleSet returns srv.RuleSet, defaulting to PermitAll.
+func (srv *Server) ruleSet() RuleSet {
+	if srv.RuleSet != nil {
+		return srv.RuleSet
+	}
+	return PermitAll
+}
+
+// resolver returns srv.Resolver, defaulting to DNSResolver.
+func (srv *Server) resolver() NameResolver {
+	if srv.Resolver != nil {
+		return srv.Resolver
+	}
+	return DNSResolver{}
+}
+
+// ListenAndServe listens on service ("host:port") and serves connections
+// until the listener errors out or Shutdown is called.
+func (srv *Server) ListenAndServe(service string) error {
+	listener, err := net.Listen("tcp", service)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+// Serve accepts connections on listener, handling each one in its own
+// goroutine, until Accept fails or Shutdown is called.
+func (srv *Server) Serve(listener net.Listener) error {
+	baseCtx := context.Background()
+	if srv.BaseContext != nil {
+		baseCtx = srv.BaseContext(listener)
+	}
+	ctx, cancel := context.WithCancel(baseCtx)
+	defer cancel()
+
+	srv.mu.Lock()
+	srv.cancel = cancel
+	srv.listener = listener
+	srv.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			log.Printf("Can't accept to %s: %v", listener.Addr(), err)
+			return err
+		}
+		go srv.handle(ctx, conn)
+	}
+}
+
+// Shutdown cancels the context passed to every in-flight connection and
+// closes the listener, causing Serve to return.
+func (srv *Server) Shutdown() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.cancel != nil {
+		srv.cancel()
+	}
+	if srv.listener != nil {
+		return srv.listener.Close()
+	}
+	return nil
+}
+
 func (s *SocksProxy) closeConnection() {
 	if s.conn == nil {
 		return
@@ -125,144 +303,144 @@ func (s *SocksProxy) closeConnectionWithError(reply socksReply) {
 	s.closeConnection()
 }
 
-func (s *SocksProxy) ensureVersion(version uint8) {
-	if version != socksVersion {
-		s.closeConnectionWithError(generalFailure)
+func (s *SocksProxy) handleGreetings() error {
+	mr, err := statute.ParseMethodRequest(s.conn)
+	if err != nil {
+		s.closeConnection()
+		return fmt.Errorf("failed to parse method request: %v", err)
 	}
-}
+	log.Printf("handleGreetings: version=%d", mr.Version)
 
-func (s *SocksProxy) ensureNMethod(nmethod uint8) {
-	if !(1 <= nmethod && nmethod <= 255) {
+	// NOTE: the version is intentionally not checked here; some clients
+	// have been observed sending a version other than 5 at this step.
+	if len(mr.Methods) == 0 {
 		s.closeConnectionWithError(generalFailure)
+		return fmt.Errorf("connection closed due to invalid nmethod(0)")
 	}
-}
+	s.methods = mr.Methods
 
-func (s *SocksProxy) getAvailableMethods(nmethod uint8) []uint8 {
-	methods := make([]uint8, nmethod)
-	m := []byte{0}
-	for i := uint8(0); i < nmethod; i++ {
-		s.conn.Read(m)
-		methods[i] = m[0]
+	requested := make(map[uint8]struct{}, len(s.methods))
+	for _, m := range s.methods {
+		requested[m] = struct{}{}
 	}
-	return methods
-}
 
-func (s *SocksProxy) parseAddress() {
-	if s.addressType == ipv4 {
-		buf := make([]byte, 4)
-		s.conn.Read(buf)
-		s.IP = netip.AddrFrom4(*(*[4]byte)(buf))
-	} else if s.addressType == domainName {
-		domainLength := []byte{0}
-		s.conn.Read(domainLength)
-		fqdn := make([]byte, int(domainLength[0]))
-		s.conn.Read(fqdn)
-		s.FQDN = string(fqdn)
-	} else if s.addressType == ipv6 {
-		buf := make([]byte, 16)
-		s.conn.Read(buf)
-		s.IP = netip.AddrFrom16(*(*[16]byte)(buf))
-	} else {
-		log.Printf("Unknown address type (%d)", s.addressType)
-		s.closeConnectionWithError(addressTypeNotSupported)
-	}
-}
-
-func (s *SocksProxy) parsePort() {
-	buf := []byte{0, 0}
-	s.conn.Read(buf)
-	s.port = (uint16(buf[0]) << 8) | uint16(buf[1])
-}
-
-func (s *SocksProxy) handleGreetings() error {
-	version := []byte{0}
-	nmethod := []byte{0}
-	s.conn.Read(version)
-	s.conn.Read(nmethod)
-
-	log.Printf("handleGreetings: version=%d", version[0])
-	//s.ensureVersion(version[0])
-	if s.conn == nil {
-		return fmt.Errorf("connection closed due to invalid version(%d)", version[0])
+	var selected Authenticator
+	for _, code := range s.authenticatorOrder {
+		if _, ok := requested[code]; !ok {
+			continue
+		}
+		if a, ok := s.authenticators[code]; ok {
+			selected = a
+			break
+		}
 	}
-	s.ensureNMethod(nmethod[0])
-	if s.conn == nil {
-		return fmt.Errorf("connection closed due to invalid nmethod(%d)", nmethod[0])
+	if selected == nil {
+		s.conn.Write(statute.MethodReply{Version: socksVersion, Method: noAcceptable}.Bytes())
+		s.closeConnection()
+		return fmt.Errorf("no acceptable authentication method in %v", s.methods)
 	}
 
-	s.methods = s.getAvailableMethods(nmethod[0])
-
-	s.conn.Write([]byte{socksVersion, uint8(noAuth)})
+	authContext, err := selected.Authenticate(s.conn, s.conn, s.conn.RemoteAddr().String())
+	if err != nil {
+		s.closeConnection()
+		return fmt.Errorf("authentication failed: %v", err)
+	}
+	s.authContext = authContext
 	return nil
 }
 
 func (s *SocksProxy) handleRequestHeader() error {
-	// version, command, RESERVED, address_type
-	header := []byte{0, 0, 0, 0}
-	s.conn.Read(header)
-
-	s.ensureVersion(header[0])
-	if s.conn == nil {
-		return fmt.Errorf("connection closed due to invalid version(%d)", header[0])
+	req, err := statute.ParseRequest(s.conn)
+	if err != nil {
+		if errors.Is(err, statute.ErrUnsupportedAddrType) {
+			s.closeConnectionWithError(addressTypeNotSupported)
+		} else {
+			s.closeConnectionWithError(generalFailure)
+		}
+		return fmt.Errorf("failed to parse request header: %v", err)
 	}
-	s.command = socksCommand(header[1])
-	s.addressType = socksAddressType(header[3])
 
-	// may set s.IP or s.FQDN
-	s.parseAddress()
-	if s.conn == nil {
-		return fmt.Errorf("connection closed due to invalid address type(%d)", header[3])
+	if req.Version != socksVersion {
+		s.closeConnectionWithError(generalFailure)
+		return fmt.Errorf("connection closed due to invalid version(%d)", req.Version)
 	}
-	s.parsePort()
+
+	s.command = req.Command
+	s.addressType = req.DstAddr.AddrType
+	s.IP = req.DstAddr.IP
+	s.FQDN = req.DstAddr.FQDN
+	s.port = req.DstPort
 	return nil
 }
 
 // remote address to be dialed
-func (s *SocksProxy) constructRemoteAddress() string {
-	remoteAddress := ""
+func (s *SocksProxy) constructRemoteAddress(ctx context.Context) (string, error) {
 	if s.addressType == ipv4 || s.addressType == ipv6 {
-		remoteAddress = fmt.Sprintf("%v:%d", s.IP, s.port)
+		return net.JoinHostPort(s.IP.String(), strconv.Itoa(int(s.port))), nil
 	} else if s.addressType == domainName {
-		// resolve domain name to ipv4
-		ips, err := net.LookupIP(s.FQDN)
-		if err != nil || len(ips) == 0 {
+		resolver := s.resolver
+		if resolver == nil {
+			resolver = DNSResolver{}
+		}
+		_, ip, err := resolver.Resolve(ctx, s.FQDN)
+		if err != nil || ip == nil {
 			log.Printf("Closing ... could not resolve FQDN %s", s.FQDN)
 			s.closeConnectionWithError(generalFailure)
+			return "", fmt.Errorf("could not resolve FQDN %s: %v", s.FQDN, err)
 		}
-		if len(ips) > 0 {
-			log.Printf("Resolving %s:%d -> %s:%d %v", s.FQDN, s.port, ips[0], s.port, ips)
 
-			remoteAddress = fmt.Sprintf("%s:%d", ips[0], s.port)
+		log.Printf("Resolving %s:%d -> %s:%d", s.FQDN, s.port, ip, s.port)
 
-			// we are now IPv4
+		// we are now whichever address family the resolver gave us
+		if ip.To4() != nil {
 			s.addressType = ipv4
+		} else {
+			s.addressType = ipv6
 		}
-	} else {
-		log.Printf("Closing ... address type (%d) not supported", s.addressType)
-		s.closeConnectionWithError(addressTypeNotSupported)
+
+		if resolvedIP, ok := netip.AddrFromSlice(ip.To16()); ok && s.ruleSet != nil {
+			req := s.toRequest()
+			req.DstFQDN = ""
+			req.DstIP = resolvedIP.Unmap()
+			if _, allowed := s.ruleSet.Allow(ctx, req); !allowed {
+				log.Printf("Closing ... %s resolved to %s, denied by rule set", s.FQDN, ip)
+				s.closeConnectionWithError(connectionNotAllowed)
+				return "", fmt.Errorf("resolved address for %s denied by rule set", s.FQDN)
+			}
+		}
+
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(s.port))), nil
 	}
 
-	return remoteAddress
+	log.Printf("Closing ... address type (%d) not supported", s.addressType)
+	s.closeConnectionWithError(addressTypeNotSupported)
+	return "", fmt.Errorf("address type (%d) not supported", s.addressType)
 }
 
-func (s *SocksProxy) handleCommandConnect() ([]byte, error) {
-	remoteAddress := s.constructRemoteAddress()
+func (s *SocksProxy) handleCommandConnect(ctx context.Context) ([]byte, error) {
+	dst := statute.AddrSpec{AddrType: s.addressType, IP: s.IP, FQDN: s.FQDN}
+	if s.upstream != nil && s.shouldUseUpstream(dst) {
+		return s.handleCommandConnectUpstream(ctx, dst)
+	}
+
+	remoteAddress, err := s.constructRemoteAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
 	// server may be closed early due to error
 	if s.conn == nil {
 		return nil, fmt.Errorf("Connection closed early")
 	}
-	remote, err := net.Dial("tcp", remoteAddress)
+
+	dial := s.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	remote, err := dial(ctx, "tcp", remoteAddress)
 	s.remote = remote
 
 	if err != nil {
-		msg := err.Error()
-		if strings.Contains(msg, "network is unreachable") {
-			s.closeConnectionWithError(networkUnreachable)
-		} else if strings.Contains(msg, "refused") {
-			s.closeConnectionWithError(connectionRefused)
-		} else {
-			s.closeConnectionWithError(hostUnreachable)
-		}
+		s.closeConnectionWithError(dialErrorReply(err))
 		return nil, fmt.Errorf("Failed to dial remote: %s: %v", remoteAddress, err)
 	}
 
@@ -273,19 +451,75 @@ func (s *SocksProxy) handleCommandConnect() ([]byte, error) {
 	return s.generateSucceededReply(bindAddress.AddrPort()), nil
 }
 
+// shouldUseUpstream reports whether dst should be forwarded to the
+// upstream proxy. With no UpstreamRoute configured, everything goes via
+// the upstream once one is set.
+func (s *SocksProxy) shouldUseUpstream(dst statute.AddrSpec) bool {
+	if s.upstreamRoute == nil {
+		return true
+	}
+	return s.upstreamRoute.UseUpstream(dst)
+}
+
+// handleCommandConnectUpstream forwards the CONNECT to the upstream proxy,
+// preserving the client's original ATYP/host so domain names are resolved
+// by the upstream rather than locally. The reply's own ATYP is derived from
+// bindAddress below (via generateSucceededReply), not from dst, since the
+// bound local address belongs to this proxy's connection to the upstream.
+func (s *SocksProxy) handleCommandConnectUpstream(ctx context.Context, dst statute.AddrSpec) ([]byte, error) {
+	remote, err := s.upstream.DialUpstream(ctx, dst, s.port)
+	s.remote = remote
+	if err != nil {
+		s.closeConnectionWithError(dialErrorReply(err))
+		return nil, fmt.Errorf("Failed to dial upstream for %s: %v", dst.HostPort(s.port), err)
+	}
+
+	bindAddress := remote.LocalAddr().(*net.TCPAddr)
+	log.Printf("Connecting via upstream to: %s, binding to: %v", dst.HostPort(s.port), bindAddress)
+
+	s.reply = succeeded
+	return s.generateSucceededReply(bindAddress.AddrPort()), nil
+}
+
+// dialErrorReply classifies a dial error into the closest matching SOCKS5
+// reply code.
+func dialErrorReply(err error) socksReply {
+	msg := err.Error()
+	if strings.Contains(msg, "network is unreachable") || strings.Contains(msg, "network unreachable") {
+		return networkUnreachable
+	}
+	if strings.Contains(msg, "refused") {
+		return connectionRefused
+	}
+	return hostUnreachable
+}
+
+// addrSpecFromAddrPort builds the AddrSpec for a reply from the actual
+// bound/peer address, rather than from the client's requested address
+// type: a listener bound for BIND or UDP ASSOCIATE commonly binds the
+// unspecified IPv6 address regardless of what the client asked for, so
+// reusing the request's ATYP there would mismatch the encoded address.
+func addrSpecFromAddrPort(ap netip.AddrPort) statute.AddrSpec {
+	addrType := socksAddressType(ipv4)
+	if ap.Addr().Is6() && !ap.Addr().Is4In6() {
+		addrType = ipv6
+	}
+	return statute.AddrSpec{AddrType: addrType, IP: ap.Addr().Unmap()}
+}
+
 func (s *SocksProxy) generateReply(addrPort netip.AddrPort) []byte {
 	if !addrPort.IsValid() {
 		log.Printf("Invalid address: %v", addrPort)
 		return []byte{}
 	}
 
-	ip := addrPort.Addr().AsSlice()
-	port := addrPort.Port()
-	payload := []byte{socksVersion, uint8(s.reply), 0, uint8(s.addressType)}
-	payload = append(payload, ip...)
-	payload = append(payload, uint8(port>>8))
-	payload = append(payload, uint8(port&0xff))
-	return payload
+	reply := statute.Reply{
+		Version:  socksVersion,
+		Reply:    s.reply,
+		BindAddr: addrSpecFromAddrPort(addrPort),
+		BindPort: addrPort.Port(),
+	}
+	return reply.Bytes()
 }
 
 func (s *SocksProxy) generateSucceededReply(addrPort netip.AddrPort) []byte {
@@ -296,19 +530,25 @@ func (s *SocksProxy) generateFailedReply(addrPort netip.AddrPort) []byte {
 	return s.generateReply(addrPort)
 }
 
-func (s *SocksProxy) handleRequestCommand() ([]byte, error) {
+func (s *SocksProxy) handleRequestCommand(ctx context.Context) ([]byte, error) {
 	if s.command == connect {
-		reply, err := s.handleCommandConnect()
+		reply, err := s.handleCommandConnect(ctx)
 		if err != nil {
 			return nil, err
 		}
 		return reply, nil
 	} else if s.command == bind {
-		log.Printf("Bind command is not supported")
-		s.closeConnectionWithError(commandNotSupported)
+		reply, err := s.handleCommandBind(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
 	} else if s.command == udpAssociate {
-		log.Printf("UDP associate command is not supported")
-		s.closeConnectionWithError(commandNotSupported)
+		reply, err := s.handleCommandUDPAssociate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
 	} else {
 		log.Printf("Unknown command")
 		s.closeConnectionWithError(commandNotSupported)
@@ -316,18 +556,44 @@ func (s *SocksProxy) handleRequestCommand() ([]byte, error) {
 	return nil, fmt.Errorf("Unsupported command (%d)", s.command)
 }
 
-func (s *SocksProxy) doReplyAction() error {
-	if s.command == connect {
-		if s.reply == succeeded {
-			if err := exchange(s.conn, s.remote); err != nil {
-				log.Printf("Error on exchange: %v", err)
-				return err
-			}
+func (s *SocksProxy) doReplyAction(ctx context.Context) error {
+	if s.reply != succeeded {
+		return nil
+	}
+
+	switch s.command {
+	case connect, bind:
+		if err := exchange(s.conn, s.remote); err != nil {
+			log.Printf("Error on exchange: %v", err)
+			return err
 		}
+	case udpAssociate:
+		s.serveUDPAssociate(ctx)
 	}
 	return nil
 }
 
+// serveUDPAssociate relays UDP datagrams until the controlling TCP
+// connection is closed, tearing the relay down along with it.
+func (s *SocksProxy) serveUDPAssociate(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.udpAssoc.serve(ctx)
+
+	// Block until the client closes the TCP connection; any byte sent on
+	// it is unexpected for an active association and is ignored.
+	buf := make([]byte, 1)
+	for {
+		if _, err := s.conn.Read(buf); err != nil {
+			break
+		}
+	}
+	cancel()
+	s.udpAssoc.serverConn.Close()
+	s.udpAssoc.closeAllDests()
+}
+
 // exchange data between two net.Conn
 func exchange(client net.Conn, remote net.Conn) error {
 	var wg sync.WaitGroup
@@ -350,43 +616,82 @@ func exchange(client net.Conn, remote net.Conn) error {
 	return nil
 }
 
-func handle(conn net.Conn) {
-	server := NewProxy(conn)
-	defer server.closeConnection()
+// handle serves a single accepted connection. ctx is cancelled when the
+// server shuts down, at which point any blocking read/write on conn is
+// unblocked by forcing its deadline into the past.
+func (srv *Server) handle(ctx context.Context, conn net.Conn) {
+	proxy := NewProxy(conn)
+	if len(srv.Authenticators) > 0 {
+		proxy.SetAuthenticators(srv.Authenticators...)
+	}
+	proxy.dial = srv.dialFunc()
+	proxy.resolver = srv.resolver()
+	proxy.ruleSet = srv.ruleSet()
+	proxy.upstream = srv.Upstream
+	proxy.upstreamRoute = srv.UpstreamRoute
+	defer proxy.closeConnection()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
 
 	log.Printf("Accepting connection from: %s", conn.RemoteAddr())
 
-	err := server.handleGreetings()
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	err := proxy.handleGreetings()
 	if err != nil {
 		log.Printf("Connection closed early on handleGreetings, %v", err)
 		return
 	}
-	err = server.handleRequestHeader()
+	err = proxy.handleRequestHeader()
 	if err != nil {
 		log.Printf("Connection closed early on handleRequestHeader, %v", err)
 		return
 	}
 
-	payload, err := server.handleRequestCommand()
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	req := proxy.toRequest()
+	newCtx, ok := srv.ruleSet().Allow(ctx, req)
+	if !ok {
+		log.Printf("Denied by rule set: %+v", req)
+		proxy.closeConnectionWithError(connectionNotAllowed)
+		return
+	}
+	ctx = newCtx
+
+	payload, err := proxy.handleRequestCommand(ctx)
 	if err != nil {
 		log.Printf("Error on handleRequestCommand: %v", err)
 		return
 	}
 	if len(payload) > 0 {
-		if _, err := server.conn.Write(payload); err != nil {
+		if _, err := proxy.conn.Write(payload); err != nil {
 			log.Printf("Error on Sending back request: %v", err)
 			return
 		}
 	}
 
-	if err := server.doReplyAction(); err != nil {
+	if err := proxy.doReplyAction(ctx); err != nil {
 		log.Printf("Error on doReplyAction: %v", err)
 		return
 	}
 
-	if server.remote != nil {
-		log.Printf("Closing remote: %s", server.remote.RemoteAddr())
-		server.remote.Close()
+	if proxy.remote != nil {
+		log.Printf("Closing remote: %s", proxy.remote.RemoteAddr())
+		proxy.remote.Close()
 	}
 }
 
@@ -403,18 +708,9 @@ func serve() {
 	service := fmt.Sprintf("%s:%d", bindAddress, port)
 	log.Printf("Running on: %s", service)
 
-	listener, err := net.Listen("tcp", service)
-	if err != nil {
-		log.Fatalf("Can't listen to %s: %v", service, err)
-	}
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatalf("Can't accept to %s: %v", service, err)
-			continue
-		}
-		go handle(conn)
+	srv := NewServer()
+	if err := srv.ListenAndServe(service); err != nil {
+		log.Fatalf("Server error: %v", err)
 	}
 }
 
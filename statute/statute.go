@@ -0,0 +1,326 @@
+// Package statute defines the SOCKS5 wire types used by the proxy: typed
+// request/reply structs with ParseX(io.Reader) and Bytes() methods, built
+// on io.ReadFull so malformed or short reads surface as errors instead of
+// silently corrupting parser state.
+package statute
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// ErrUnsupportedAddrType is returned by ParseAddrSpec (and so ParseRequest
+// and ParseUDPHeader) when the ATYP byte is not one of IPv4/domain/IPv6.
+var ErrUnsupportedAddrType = errors.New("unsupported address type")
+
+// VersionSocks5 is the only protocol version this package understands.
+const VersionSocks5 = uint8(0x05)
+
+// Command is a SOCKS5 request command.
+type Command uint8
+
+const (
+	CommandConnect      = Command(0x01)
+	CommandBind         = Command(0x02)
+	CommandUDPAssociate = Command(0x03)
+)
+
+// AddrType is a SOCKS5 address type (ATYP).
+type AddrType uint8
+
+const (
+	ATYPIPv4   = AddrType(0x01)
+	ATYPDomain = AddrType(0x03)
+	ATYPIPv6   = AddrType(0x04)
+)
+
+// ReplyCode is a SOCKS5 reply status (REP).
+type ReplyCode uint8
+
+const (
+	RepSuccess              = ReplyCode(0x00)
+	RepGeneralFailure       = ReplyCode(0x01)
+	RepConnectionNotAllowed = ReplyCode(0x02)
+	RepNetworkUnreachable   = ReplyCode(0x03)
+	RepHostUnreachable      = ReplyCode(0x04)
+	RepConnectionRefused    = ReplyCode(0x05)
+	RepTTLExpired           = ReplyCode(0x06)
+	RepCommandNotSupported  = ReplyCode(0x07)
+	RepAddrTypeNotSupported = ReplyCode(0x08)
+)
+
+func (r ReplyCode) String() string {
+	switch r {
+	case RepSuccess:
+		return "succeeded"
+	case RepGeneralFailure:
+		return "general failure"
+	case RepConnectionNotAllowed:
+		return "connection not allowed"
+	case RepNetworkUnreachable:
+		return "network unreachable"
+	case RepHostUnreachable:
+		return "host unreachable"
+	case RepConnectionRefused:
+		return "connection refused"
+	case RepTTLExpired:
+		return "ttl expired"
+	case RepCommandNotSupported:
+		return "command not supported"
+	case RepAddrTypeNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown(%d)", r)
+	}
+}
+
+// MethodRequest is the client's greeting: the methods it is willing to
+// authenticate with.
+type MethodRequest struct {
+	Version uint8
+	Methods []uint8
+}
+
+// ParseMethodRequest reads a MethodRequest from r.
+func ParseMethodRequest(r io.Reader) (MethodRequest, error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return MethodRequest{}, fmt.Errorf("failed to read method request header: %v", err)
+	}
+
+	nmethods := header[1]
+	methods := make([]byte, nmethods)
+	if nmethods > 0 {
+		if _, err := io.ReadFull(r, methods); err != nil {
+			return MethodRequest{}, fmt.Errorf("failed to read methods: %v", err)
+		}
+	}
+
+	return MethodRequest{Version: header[0], Methods: methods}, nil
+}
+
+// Bytes encodes the greeting for writing to a SOCKS5 server, e.g. when
+// acting as a client of an upstream proxy.
+func (m MethodRequest) Bytes() []byte {
+	out := []byte{m.Version, uint8(len(m.Methods))}
+	return append(out, m.Methods...)
+}
+
+// MethodReply is the server's answer to a MethodRequest: the method it
+// selected (or 0xFF if none were acceptable).
+type MethodReply struct {
+	Version uint8
+	Method  uint8
+}
+
+// ParseMethodReply reads a MethodReply from r.
+func ParseMethodReply(r io.Reader) (MethodReply, error) {
+	buf := []byte{0, 0}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return MethodReply{}, fmt.Errorf("failed to read method reply: %v", err)
+	}
+	return MethodReply{Version: buf[0], Method: buf[1]}, nil
+}
+
+// Bytes encodes the reply for writing to the client.
+func (m MethodReply) Bytes() []byte {
+	return []byte{m.Version, m.Method}
+}
+
+// AddrSpec is a destination or bound address as it appears on the wire:
+// either an IP or a domain name, never both.
+type AddrSpec struct {
+	AddrType AddrType
+	IP       netip.Addr
+	FQDN     string
+}
+
+// ParseAddrSpec reads an address of the given type from r.
+func ParseAddrSpec(r io.Reader, addrType AddrType) (AddrSpec, error) {
+	switch addrType {
+	case ATYPIPv4:
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return AddrSpec{}, fmt.Errorf("failed to read ipv4 address: %v", err)
+		}
+		return AddrSpec{AddrType: addrType, IP: netip.AddrFrom4(*(*[4]byte)(buf))}, nil
+	case ATYPIPv6:
+		buf := make([]byte, 16)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return AddrSpec{}, fmt.Errorf("failed to read ipv6 address: %v", err)
+		}
+		return AddrSpec{AddrType: addrType, IP: netip.AddrFrom16(*(*[16]byte)(buf))}, nil
+	case ATYPDomain:
+		lengthBuf := []byte{0}
+		if _, err := io.ReadFull(r, lengthBuf); err != nil {
+			return AddrSpec{}, fmt.Errorf("failed to read domain length: %v", err)
+		}
+		fqdn := make([]byte, int(lengthBuf[0]))
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return AddrSpec{}, fmt.Errorf("failed to read domain name: %v", err)
+		}
+		return AddrSpec{AddrType: addrType, FQDN: string(fqdn)}, nil
+	default:
+		return AddrSpec{}, fmt.Errorf("%w (%d)", ErrUnsupportedAddrType, addrType)
+	}
+}
+
+// Bytes encodes the address for writing to the wire. It does not include
+// the leading ATYP byte, since that is written alongside the command or
+// reply that carries the address.
+func (a AddrSpec) Bytes() []byte {
+	if a.AddrType == ATYPDomain {
+		out := []byte{uint8(len(a.FQDN))}
+		return append(out, []byte(a.FQDN)...)
+	}
+	return a.IP.AsSlice()
+}
+
+// HostPort joins the address with port the way net.JoinHostPort does,
+// suitable for passing to net.Dial.
+func (a AddrSpec) HostPort(port uint16) string {
+	host := a.FQDN
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// ParsePort reads a 16-bit big-endian port from r.
+func ParsePort(r io.Reader) (uint16, error) {
+	buf := []byte{0, 0}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, fmt.Errorf("failed to read port: %v", err)
+	}
+	return (uint16(buf[0]) << 8) | uint16(buf[1]), nil
+}
+
+// PortBytes encodes port as big-endian, for appending after an AddrSpec.
+func PortBytes(port uint16) []byte {
+	return []byte{uint8(port >> 8), uint8(port & 0xff)}
+}
+
+// Request is a parsed SOCKS5 request header (CONNECT/BIND/UDP ASSOCIATE).
+type Request struct {
+	Version uint8
+	Command Command
+	DstAddr AddrSpec
+	DstPort uint16
+}
+
+// ParseRequest reads a Request from r.
+func ParseRequest(r io.Reader) (Request, error) {
+	header := []byte{0, 0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Request{}, fmt.Errorf("failed to read request header: %v", err)
+	}
+
+	addr, err := ParseAddrSpec(r, AddrType(header[3]))
+	if err != nil {
+		return Request{}, err
+	}
+	port, err := ParsePort(r)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Version: header[0],
+		Command: Command(header[1]),
+		DstAddr: addr,
+		DstPort: port,
+	}, nil
+}
+
+// Bytes encodes the request for writing to a SOCKS5 server, e.g. when
+// acting as a client of an upstream proxy.
+func (r Request) Bytes() []byte {
+	out := []byte{r.Version, uint8(r.Command), 0, uint8(r.DstAddr.AddrType)}
+	out = append(out, r.DstAddr.Bytes()...)
+	return append(out, PortBytes(r.DstPort)...)
+}
+
+// Reply is a SOCKS5 reply to a Request.
+type Reply struct {
+	Version  uint8
+	Reply    ReplyCode
+	BindAddr AddrSpec
+	BindPort uint16
+}
+
+// ParseReply reads a Reply from r.
+func ParseReply(r io.Reader) (Reply, error) {
+	header := []byte{0, 0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Reply{}, fmt.Errorf("failed to read reply header: %v", err)
+	}
+
+	addr, err := ParseAddrSpec(r, AddrType(header[3]))
+	if err != nil {
+		return Reply{}, err
+	}
+	port, err := ParsePort(r)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	return Reply{
+		Version:  header[0],
+		Reply:    ReplyCode(header[1]),
+		BindAddr: addr,
+		BindPort: port,
+	}, nil
+}
+
+// Bytes encodes the reply for writing to the client.
+func (r Reply) Bytes() []byte {
+	out := []byte{r.Version, uint8(r.Reply), 0, uint8(r.BindAddr.AddrType)}
+	out = append(out, r.BindAddr.Bytes()...)
+	return append(out, PortBytes(r.BindPort)...)
+}
+
+// UDPHeader is the header prepended to every datagram relayed through a
+// UDP ASSOCIATE session: RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA.
+type UDPHeader struct {
+	Frag    uint8
+	DstAddr AddrSpec
+	DstPort uint16
+}
+
+// ParseUDPHeader parses the header from the front of a datagram and
+// returns it along with the remaining payload.
+func ParseUDPHeader(b []byte) (UDPHeader, []byte, error) {
+	if len(b) < 4 {
+		return UDPHeader{}, nil, fmt.Errorf("UDP datagram too short (%d bytes)", len(b))
+	}
+
+	frag := b[2]
+	addrType := AddrType(b[3])
+
+	r := bytes.NewReader(b[4:])
+	addr, err := ParseAddrSpec(r, addrType)
+	if err != nil {
+		return UDPHeader{}, nil, err
+	}
+	port, err := ParsePort(r)
+	if err != nil {
+		return UDPHeader{}, nil, err
+	}
+
+	payload := make([]byte, r.Len())
+	io.ReadFull(r, payload)
+
+	return UDPHeader{Frag: frag, DstAddr: addr, DstPort: port}, payload, nil
+}
+
+// Bytes encodes the header for prepending to a relayed datagram.
+func (h UDPHeader) Bytes() []byte {
+	out := []byte{0, 0, h.Frag, uint8(h.DstAddr.AddrType)}
+	out = append(out, h.DstAddr.Bytes()...)
+	return append(out, PortBytes(h.DstPort)...)
+}
@@ -0,0 +1,113 @@
+package statute
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestMethodRequestRoundTrip(t *testing.T) {
+	want := MethodRequest{Version: VersionSocks5, Methods: []uint8{0x00, 0x02}}
+	got, err := ParseMethodRequest(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseMethodRequest: %v", err)
+	}
+	if got.Version != want.Version || !bytes.Equal(got.Methods, want.Methods) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestMethodReplyRoundTrip(t *testing.T) {
+	want := MethodReply{Version: VersionSocks5, Method: 0x02}
+	got, err := ParseMethodReply(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseMethodReply: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRequestRoundTripDomain(t *testing.T) {
+	want := Request{
+		Version: VersionSocks5,
+		Command: CommandConnect,
+		DstAddr: AddrSpec{AddrType: ATYPDomain, FQDN: "example.com"},
+		DstPort: 443,
+	}
+	got, err := ParseRequest(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRequestRoundTripIPv4(t *testing.T) {
+	want := Request{
+		Version: VersionSocks5,
+		Command: CommandBind,
+		DstAddr: AddrSpec{AddrType: ATYPIPv4, IP: netip.MustParseAddr("192.0.2.1")},
+		DstPort: 1080,
+	}
+	got, err := ParseRequest(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseRequestUnsupportedAddrType(t *testing.T) {
+	// version, command, rsv, ATYP=0x7f (invalid)
+	buf := []byte{VersionSocks5, uint8(CommandConnect), 0, 0x7f}
+	_, err := ParseRequest(bytes.NewReader(buf))
+	if !errors.Is(err, ErrUnsupportedAddrType) {
+		t.Errorf("ParseRequest error = %v, want ErrUnsupportedAddrType", err)
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	want := Reply{
+		Version:  VersionSocks5,
+		Reply:    RepSuccess,
+		BindAddr: AddrSpec{AddrType: ATYPIPv6, IP: netip.MustParseAddr("::1")},
+		BindPort: 1080,
+	}
+	got, err := ParseReply(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseReply: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUDPHeaderRoundTrip(t *testing.T) {
+	want := UDPHeader{
+		DstAddr: AddrSpec{AddrType: ATYPIPv4, IP: netip.MustParseAddr("203.0.113.5")},
+		DstPort: 53,
+	}
+	payload := []byte("hello")
+	buf := append(want.Bytes(), payload...)
+
+	got, rest, err := ParseUDPHeader(buf)
+	if err != nil {
+		t.Fatalf("ParseUDPHeader: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !bytes.Equal(rest, payload) {
+		t.Errorf("payload = %q, want %q", rest, payload)
+	}
+}
+
+func TestParseUDPHeaderTooShort(t *testing.T) {
+	if _, _, err := ParseUDPHeader([]byte{0, 0}); err == nil {
+		t.Error("expected an error for a too-short datagram")
+	}
+}
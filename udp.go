@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"toy-socks5/statute"
+)
+
+// udpIdleTimeout bounds how long a UDP association (and its cached
+// per-destination sockets) may sit without traffic before it is torn down.
+const udpIdleTimeout = 2 * time.Minute
+
+// udpAssociation relays datagrams between one client and the destinations
+// it talks to through a single UDP ASSOCIATE session. Its lifetime is tied
+// to the controlling TCP connection.
+type udpAssociation struct {
+	serverConn *net.UDPConn
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	dests      map[string]*net.UDPConn
+}
+
+func newUDPAssociation(serverConn *net.UDPConn) *udpAssociation {
+	return &udpAssociation{
+		serverConn: serverConn,
+		dests:      make(map[string]*net.UDPConn),
+	}
+}
+
+// serve relays datagrams until ctx is cancelled or the client socket goes
+// idle for longer than udpIdleTimeout.
+func (u *udpAssociation) serve(ctx context.Context) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			u.serverConn.Close()
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		u.serverConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, from, err := u.serverConn.ReadFromUDP(buf)
+		if err != nil {
+			u.closeAllDests()
+			return
+		}
+
+		u.mu.Lock()
+		if u.clientAddr == nil {
+			u.clientAddr = from
+		}
+		isClient := u.clientAddr.IP.Equal(from.IP) && u.clientAddr.Port == from.Port
+		u.mu.Unlock()
+		if !isClient {
+			// datagram from an unrelated sender; ignore it.
+			continue
+		}
+
+		hdr, payload, err := statute.ParseUDPHeader(buf[:n])
+		if err != nil {
+			log.Printf("UDP ASSOCIATE: dropping malformed datagram: %v", err)
+			continue
+		}
+		if hdr.Frag != 0 {
+			log.Printf("UDP ASSOCIATE: dropping fragmented datagram (FRAG=%d)", hdr.Frag)
+			continue
+		}
+
+		dstAddress := hdr.DstAddr.HostPort(hdr.DstPort)
+		destConn, err := u.getOrDialDest(ctx, dstAddress)
+		if err != nil {
+			log.Printf("UDP ASSOCIATE: failed to dial destination %s: %v", dstAddress, err)
+			continue
+		}
+		if _, err := destConn.Write(payload); err != nil {
+			log.Printf("UDP ASSOCIATE: failed to write to destination %s: %v", dstAddress, err)
+		}
+	}
+}
+
+// getOrDialDest returns the cached UDP socket for address, dialing and
+// caching a new one (with a goroutine relaying its replies back to the
+// client) if none exists yet.
+func (u *udpAssociation) getOrDialDest(ctx context.Context, address string) (*net.UDPConn, error) {
+	u.mu.Lock()
+	if c, ok := u.dests[address]; ok {
+		u.mu.Unlock()
+		return c, nil
+	}
+	u.mu.Unlock()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	destConn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	u.dests[address] = destConn
+	u.mu.Unlock()
+
+	go u.relayFromDest(ctx, udpAddr, destConn)
+	return destConn, nil
+}
+
+// relayFromDest reads replies from a cached destination socket and
+// re-encapsulates them back to the client.
+func (u *udpAssociation) relayFromDest(ctx context.Context, dstAddr *net.UDPAddr, destConn *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		destConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := destConn.Read(buf)
+		if err != nil {
+			u.mu.Lock()
+			for address, c := range u.dests {
+				if c == destConn {
+					delete(u.dests, address)
+				}
+			}
+			u.mu.Unlock()
+			destConn.Close()
+			return
+		}
+
+		u.mu.Lock()
+		client := u.clientAddr
+		u.mu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		dstAddrPort := netip.MustParseAddrPort(dstAddr.String())
+		header := statute.UDPHeader{DstAddr: addrSpecFromAddrPort(dstAddrPort), DstPort: dstAddrPort.Port()}
+		reply := append(header.Bytes(), buf[:n]...)
+		if _, err := u.serverConn.WriteToUDP(reply, client); err != nil {
+			log.Printf("UDP ASSOCIATE: failed to relay reply to client: %v", err)
+			return
+		}
+	}
+}
+
+func (u *udpAssociation) closeAllDests() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.dests {
+		c.Close()
+	}
+}
+
+// handleCommandUDPAssociate implements the UDP ASSOCIATE command from
+// RFC 1928: bind a UDP socket, reply with its address, then relay
+// datagrams for as long as the controlling TCP connection stays open.
+func (s *SocksProxy) handleCommandUDPAssociate(ctx context.Context) ([]byte, error) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		s.closeConnectionWithError(generalFailure)
+		return nil, fmt.Errorf("failed to open UDP ASSOCIATE socket: %v", err)
+	}
+
+	bindAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	log.Printf("UDP ASSOCIATE: relaying on %v", bindAddr)
+
+	s.udpAssoc = newUDPAssociation(udpConn)
+	s.reply = succeeded
+	return s.generateSucceededReply(bindAddr.AddrPort()), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"toy-socks5/statute"
+)
+
+// ProxyDialer forwards a CONNECT to some upstream, letting this proxy act
+// as a filtering front-end for Tor or another SOCKS5 hop.
+type ProxyDialer interface {
+	// DialUpstream performs the CONNECT handshake against the upstream
+	// for dst:port, forwarding dst unresolved (e.g. an FQDN is sent as a
+	// domain name rather than being resolved locally first).
+	DialUpstream(ctx context.Context, dst statute.AddrSpec, port uint16) (net.Conn, error)
+}
+
+// SocksUpstreamDialer is a ProxyDialer that speaks SOCKS5 to an upstream
+// server, optionally authenticating with a fixed username/password.
+type SocksUpstreamDialer struct {
+	// Address is the upstream SOCKS5 server, "host:port".
+	Address string
+	// Username and Password, if Username is non-empty, are offered via
+	// RFC 1929 user/pass subnegotiation.
+	Username string
+	Password string
+}
+
+func (d *SocksUpstreamDialer) DialUpstream(ctx context.Context, dst statute.AddrSpec, port uint16) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream %s: %v", d.Address, err)
+	}
+
+	if err := d.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: dst,
+		DstPort: port,
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send upstream CONNECT request: %v", err)
+	}
+
+	reply, err := statute.ParseReply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read upstream CONNECT reply: %v", err)
+	}
+	if reply.Reply != statute.RepSuccess {
+		conn.Close()
+		return nil, fmt.Errorf("upstream CONNECT failed: %v", reply.Reply)
+	}
+
+	return conn, nil
+}
+
+// handshake performs the method negotiation (and user/pass subnegotiation,
+// if configured) against the already-dialed upstream connection.
+func (d *SocksUpstreamDialer) handshake(conn net.Conn) error {
+	methods := []uint8{noAuthCode}
+	if d.Username != "" {
+		methods = append(methods, userPassCode)
+	}
+	greeting := statute.MethodRequest{Version: statute.VersionSocks5, Methods: methods}
+	if _, err := conn.Write(greeting.Bytes()); err != nil {
+		return fmt.Errorf("failed to send upstream greeting: %v", err)
+	}
+
+	mr, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read upstream method reply: %v", err)
+	}
+
+	switch mr.Method {
+	case noAuthCode:
+		return nil
+	case userPassCode:
+		return d.authenticate(conn)
+	default:
+		return fmt.Errorf("upstream rejected all authentication methods (0x%02x)", mr.Method)
+	}
+}
+
+// authenticate performs the RFC 1929 user/pass subnegotiation.
+func (d *SocksUpstreamDialer) authenticate(conn net.Conn) error {
+	req := []byte{userPassVersion, uint8(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, uint8(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to send upstream credentials: %v", err)
+	}
+
+	reply := []byte{0, 0}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read upstream auth reply: %v", err)
+	}
+	if reply[1] != userPassAuthSuccess {
+		return fmt.Errorf("upstream rejected credentials")
+	}
+	return nil
+}
+
+// UpstreamRoute decides whether a destination should be forwarded to the
+// upstream proxy instead of being dialed directly.
+type UpstreamRoute interface {
+	UseUpstream(dst statute.AddrSpec) bool
+}
+
+// OnionAndCIDRRoute routes ".onion" names and any address within CIDRs via
+// the upstream, and everything else direct.
+type OnionAndCIDRRoute struct {
+	CIDRs []*net.IPNet
+}
+
+func (r *OnionAndCIDRRoute) UseUpstream(dst statute.AddrSpec) bool {
+	if dst.FQDN != "" {
+		return matchFQDNPattern("*.onion", dst.FQDN)
+	}
+	ip := net.IP(dst.IP.AsSlice())
+	for _, n := range r.CIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}